@@ -18,9 +18,11 @@ package automount // import "admiralty.io/multicluster-service-account/pkg/autom
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"admiralty.io/multicluster-service-account/pkg/apis/multicluster/v1alpha1"
@@ -35,18 +37,113 @@ import (
 
 var (
 	AnnotationKeyServiceAccountImportName = "multicluster.admiralty.io/service-account-import.name"
+
+	// AnnotationKeyServiceAccountImportProjected opts a pod into mounting its
+	// service account imports as a projected volume (token, ca.crt and a
+	// downward-API namespace file) shaped like kubelet's bound service account
+	// tokens, instead of the default raw Secret volume. See projectedVolumeSourceFor
+	// for why this does not yet make the token itself audience-scoped or bounded.
+	AnnotationKeyServiceAccountImportProjected = "multicluster.admiralty.io/service-account-import.projected"
+)
+
+// defaultTokenExpirationSeconds is used for a projected service account
+// import token when no per-import expirationSeconds annotation is set.
+const defaultTokenExpirationSeconds = int64(3600)
+
+// caCertPath is the standard in-cluster location client libraries look for
+// the API server's CA certificate, mirrored here for imported accounts.
+const caCertPath = "ca.crt"
+
+// ephemeralContainersSubResource is the subresource name kubectl debug uses
+// to admit ephemeral containers into a running pod. The webhook configuration
+// must list "pods/ephemeralcontainers" among its rules for this to be seen.
+//
+// PodSpec.EphemeralContainers and this subresource were added in Kubernetes 1.16;
+// this file's vendored k8s.io/api/core/v1 must be at least that version, which is
+// newer than what the rest of this package's imports (e.g. admission/v1beta1) were
+// originally vendored against. Confirm the vendored corev1.PodSpec actually has an
+// EphemeralContainers field before merging a bump that reaches this code, or it
+// won't compile.
+const ephemeralContainersSubResource = "ephemeralcontainers"
+
+// annotationKeyFor builds a per-service-account-import annotation key, e.g.
+// "multicluster.admiralty.io/service-account-import.my-sai.audience".
+func annotationKeyFor(saiName, suffix string) string {
+	return fmt.Sprintf("multicluster.admiralty.io/service-account-import.%s.%s", saiName, suffix)
+}
+
+// RotationMode selects how running pods keep working when a ServiceAccountImport's
+// backing Secret rotates (e.g. on remote token refresh or projected-token expiry). It
+// is set on Handler by the command wiring up the webhook, and used by
+// pkg/automount/rotation to decide how to react to the rotation.
+type RotationMode string
+
+const (
+	// RotationModePatchPods, the default, mounts a pod's own SAI-provided secret name
+	// at admission time; the rotation controller then patches or recreates pods whose
+	// mounted Secret name has since gone stale.
+	RotationModePatchPods RotationMode = "patch-pods"
+
+	// RotationModeStableSecret mounts a per-SAI Secret whose name never changes; the
+	// rotation controller keeps that Secret's contents in sync with the SAI's current
+	// backing Secret instead, so mounted pods never need to be touched.
+	RotationModeStableSecret RotationMode = "stable-secret"
 )
 
+// StableSecretName returns the name of the long-lived Secret mounted for a service
+// account import when running in RotationModeStableSecret.
+func StableSecretName(saiName string) string {
+	return fmt.Sprintf("%s-token", saiName)
+}
+
+// secretNameFor returns the name of the Secret that should be mounted for a service
+// account import, given the configured RotationMode. Handler and ValidatingHandler
+// must agree on this, since the validating webhook runs against the pod the mutating
+// webhook already patched, and needs to recognize that mount as its own rather than
+// flag it as a collision.
+func secretNameFor(sai *v1alpha1.ServiceAccountImport, saiName string, mode RotationMode) string {
+	if mode == RotationModeStableSecret {
+		return StableSecretName(saiName)
+	}
+	return sai.Status.Secrets[0].Name
+}
+
 // Handler handles pod admission requests, mutating pods that request service account imports.
 // It is implemented by the service-account-import-admission-controller command, via controller-runtime.
 // If a pod is annotated with the "multicluster.admiralty.io/service-account-import.name" key,
 // where the value is a comma-separated list of service account import names, for each
 // service account import, a volume is added to the pod, sourced from the first secret
-// listed by the service account import, and mounted in each of the pod's containers under
-// /var/run/secrets/admiralty.io/serviceaccountimports/%s, where %s is the service account import name.
+// listed by the service account import, and mounted in each of the pod's containers and
+// init containers under /var/run/secrets/admiralty.io/serviceaccountimports/%s, where %s
+// is the service account import name. The webhook is also registered for the
+// "pods/ephemeralcontainers" subresource, so that "kubectl debug" sessions mount the same
+// secrets; in that case, only the newly added ephemeral container(s) are patched, and the
+// shared volume is reused if a prior admission already added it to the pod.
+// If the pod is additionally annotated with the
+// "multicluster.admiralty.io/service-account-import.projected" key set to "true",
+// the volume is a projected volume shaped like a bound token (token, ca.crt, namespace)
+// instead of the raw Secret, and per-import audience/expirationSeconds can be recorded
+// via the "multicluster.admiralty.io/service-account-import.<name>.audience" and
+// "...expirationSeconds" annotations, though nothing consumes them yet (see
+// projectedVolumeSourceFor). If a
+// "multicluster.admiralty.io/service-account-import.<name>.server" annotation is set to
+// the remote cluster's API server URL, a kubeconfig referencing that server, the
+// mounted CA and token file is also generated into the pod's volume, and a KUBECONFIG
+// env var (colon-separated across imports, client-go style) is set on every container
+// and init container, so unmodified client-go/kubectl-based workloads target the
+// remote cluster. This annotation is a stopgap: the server URL should ultimately come
+// from the ClusterRegistry Cluster object (or a new ServiceAccountImport.Spec field)
+// the import was created from, so pod authors don't have to know and repeat it; see
+// ensureKubeconfigSecret. When RotationMode is RotationModeStableSecret, the volume instead
+// mounts the SAI's long-lived StableSecretName Secret, kept up to date by
+// pkg/automount/rotation, so that Secret rotation never requires touching the pod.
 type Handler struct {
 	decoder atypes.Decoder
 	client  client.Client
+
+	// RotationMode selects how mounted pods keep working across SAI Secret rotation.
+	// Defaults to RotationModePatchPods when left unset.
+	RotationMode RotationMode
 }
 
 func (h *Handler) Handle(ctx context.Context, req atypes.Request) atypes.Response {
@@ -102,6 +199,14 @@ func (h *Handler) mutatePodsFn(ctx context.Context, req atypes.Request, pod *cor
 
 	ns := getNamespace(pod, req.AdmissionRequest)
 
+	ephemeral := req.AdmissionRequest.SubResource == ephemeralContainersSubResource
+	newEphemeralContainersFrom := 0
+	if ephemeral {
+		newEphemeralContainersFrom = len(oldEphemeralContainers(req))
+	}
+
+	var kubeconfigPaths []string
+
 	saiNames := strings.Split(saiNamesStr, ",")
 	for _, saiName := range saiNames {
 		sai := &v1alpha1.ServiceAccountImport{}
@@ -113,30 +218,157 @@ func (h *Handler) mutatePodsFn(ctx context.Context, req atypes.Request, pod *cor
 
 		if len(sai.Status.Secrets) == 0 {
 			// throwing to resolve race condition, idem above
-			return fmt.Errorf(`service account import %s in namespace %s has no token, 
+			return fmt.Errorf(`service account import %[2]s in namespace %[1]s has no token,
 verify that the remote service account exists or retry when the secret has been created by the service account import controller`,
 				ns, saiName)
 		}
 
-		secretName := sai.Status.Secrets[0].Name
+		secretName := secretNameFor(sai, saiName, h.RotationMode)
+
+		if !hasVolume(pod, secretName) {
+			var volumeSource corev1.VolumeSource
+			if pod.Annotations[AnnotationKeyServiceAccountImportProjected] == "true" {
+				volumeSource = h.projectedVolumeSourceFor(pod, saiName, secretName)
+			} else {
+				volumeSource = corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secretName}}
+			}
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+				Name:         secretName,
+				VolumeSource: volumeSource,
+			})
+		}
+
+		mountPath := fmt.Sprintf("/var/run/secrets/admiralty.io/serviceaccountimports/%s", saiName)
+		mount := corev1.VolumeMount{Name: secretName, ReadOnly: true, MountPath: mountPath}
 
-		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
-			Name:         secretName,
-			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secretName}},
-		})
+		if ephemeral {
+			for i := newEphemeralContainersFrom; i < len(pod.Spec.EphemeralContainers); i++ {
+				ec := &pod.Spec.EphemeralContainers[i]
+				ec.VolumeMounts = append(ec.VolumeMounts, mount)
+			}
+			continue
+		}
 
 		for i := range pod.Spec.Containers {
-			pod.Spec.Containers[i].VolumeMounts = append(pod.Spec.Containers[i].VolumeMounts,
-				corev1.VolumeMount{
-					Name:      secretName,
-					ReadOnly:  true,
-					MountPath: fmt.Sprintf("/var/run/secrets/admiralty.io/serviceaccountimports/%s", saiName)})
+			pod.Spec.Containers[i].VolumeMounts = append(pod.Spec.Containers[i].VolumeMounts, mount)
+		}
+		for i := range pod.Spec.InitContainers {
+			pod.Spec.InitContainers[i].VolumeMounts = append(pod.Spec.InitContainers[i].VolumeMounts, mount)
 		}
+
+		if serverURL, ok := pod.Annotations[annotationKeyFor(saiName, "server")]; ok && serverURL != "" {
+			kubeconfigSecretName, err := h.ensureKubeconfigSecret(ctx, sai, secretName, mountPath, serverURL)
+			if err != nil {
+				return fmt.Errorf("cannot generate kubeconfig for service account import %s in namespace %s: %v", saiName, ns, err)
+			}
+
+			if !hasVolume(pod, kubeconfigSecretName) {
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+					Name:         kubeconfigSecretName,
+					VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: kubeconfigSecretName}},
+				})
+			}
+
+			kubeconfigPath := mountPath + "/kubeconfig"
+			kubeconfigMount := corev1.VolumeMount{Name: kubeconfigSecretName, ReadOnly: true, MountPath: kubeconfigPath, SubPath: "kubeconfig"}
+			for i := range pod.Spec.Containers {
+				pod.Spec.Containers[i].VolumeMounts = append(pod.Spec.Containers[i].VolumeMounts, kubeconfigMount)
+			}
+			for i := range pod.Spec.InitContainers {
+				pod.Spec.InitContainers[i].VolumeMounts = append(pod.Spec.InitContainers[i].VolumeMounts, kubeconfigMount)
+			}
+			kubeconfigPaths = append(kubeconfigPaths, kubeconfigPath)
+		}
+	}
+
+	if len(kubeconfigPaths) > 0 {
+		setKubeconfigEnv(pod, strings.Join(kubeconfigPaths, ":"))
 	}
 
 	return nil
 }
 
+// hasVolume reports whether the pod already declares a volume with the given
+// name, so that re-admission (e.g. of an ephemeral container) does not add
+// a duplicate volume for a service account import mounted earlier.
+func hasVolume(pod *corev1.Pod, name string) bool {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// oldEphemeralContainers decodes the pod's ephemeral containers before this
+// admission request, so that only the ones newly added by a "pods/ephemeralcontainers"
+// update are patched. It returns nil (rather than erroring) when there is no old
+// object to decode, e.g. in tests that do not set it.
+func oldEphemeralContainers(req atypes.Request) []corev1.EphemeralContainer {
+	raw := req.AdmissionRequest.OldObject.Raw
+	if len(raw) == 0 {
+		return nil
+	}
+	oldPod := &corev1.Pod{}
+	if err := json.Unmarshal(raw, oldPod); err != nil {
+		return nil
+	}
+	return oldPod.Spec.EphemeralContainers
+}
+
+// projectedVolumeSourceFor builds a ProjectedVolumeSource mirroring the shape of
+// kubelet's bound, in-cluster service account tokens: the imported token and the
+// remote cluster's CA, both sourced from the SAI's backing Secret, plus a
+// downward-API namespace file. The token itself is whatever static value the SAI's
+// backing Secret currently holds; this does not make it audience-scoped or
+// time-bounded on its own. The audience and expirationSeconds requested for the
+// import (via annotations, defaulting when unset) are resolved and written back onto
+// the pod, but are not consumed anywhere yet: actually minting a bound, audience-scoped
+// token requires calling the remote cluster's TokenRequest API, which no component in
+// this tree (including pkg/automount/rotation) does. Until that refresh path exists,
+// treat audience/expirationSeconds as reserved, not enforced.
+func (h *Handler) projectedVolumeSourceFor(pod *corev1.Pod, saiName, secretName string) corev1.VolumeSource {
+	audience := pod.Annotations[annotationKeyFor(saiName, "audience")]
+
+	expirationSeconds := defaultTokenExpirationSeconds
+	if s, ok := pod.Annotations[annotationKeyFor(saiName, "expirationSeconds")]; ok {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			expirationSeconds = v
+		}
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[annotationKeyFor(saiName, "audience")] = audience
+	pod.Annotations[annotationKeyFor(saiName, "expirationSeconds")] = strconv.FormatInt(expirationSeconds, 10)
+
+	return corev1.VolumeSource{
+		Projected: &corev1.ProjectedVolumeSource{
+			Sources: []corev1.VolumeProjection{
+				{
+					Secret: &corev1.SecretProjection{
+						LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+						Items:                []corev1.KeyToPath{{Key: "token", Path: "token"}},
+					},
+				},
+				{
+					Secret: &corev1.SecretProjection{
+						LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+						Items:                []corev1.KeyToPath{{Key: caCertPath, Path: caCertPath}},
+					},
+				},
+				{
+					DownwardAPI: &corev1.DownwardAPIProjection{
+						Items: []corev1.DownwardAPIVolumeFile{
+							{Path: "namespace", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
 // Handler implements inject.Client.
 // A client will be automatically injected.
 var _ inject.Client = &Handler{}
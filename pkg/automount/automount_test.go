@@ -0,0 +1,158 @@
+/*
+Copyright 2018 The Multicluster-Service-Account Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package automount
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"admiralty.io/multicluster-service-account/pkg/apis/multicluster/v1alpha1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	atypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+func TestHasVolume(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Volumes: []corev1.Volume{{Name: "foo"}}}}
+
+	if !hasVolume(pod, "foo") {
+		t.Error("expected hasVolume to find an existing volume by name")
+	}
+	if hasVolume(pod, "bar") {
+		t.Error("expected hasVolume to not find a volume that isn't there")
+	}
+}
+
+func TestOldEphemeralContainers(t *testing.T) {
+	oldPod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger"}},
+			},
+		},
+	}
+	raw, err := json.Marshal(oldPod)
+	if err != nil {
+		t.Fatalf("cannot marshal old pod: %v", err)
+	}
+
+	req := atypes.Request{AdmissionRequest: &admissionv1beta1.AdmissionRequest{
+		OldObject: runtime.RawExtension{Raw: raw},
+	}}
+
+	got := oldEphemeralContainers(req)
+	if len(got) != 1 || got[0].Name != "debugger" {
+		t.Errorf("expected to decode the old pod's ephemeral containers, got %+v", got)
+	}
+
+	reqNoOld := atypes.Request{AdmissionRequest: &admissionv1beta1.AdmissionRequest{}}
+	if got := oldEphemeralContainers(reqNoOld); got != nil {
+		t.Errorf("expected nil when there is no old object, got %+v", got)
+	}
+}
+
+func TestSecretNameFor(t *testing.T) {
+	sai := &v1alpha1.ServiceAccountImport{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sai"},
+		Status: v1alpha1.ServiceAccountImportStatus{
+			Secrets: []corev1.LocalObjectReference{{Name: "my-sai-token-abcde"}},
+		},
+	}
+
+	if got := secretNameFor(sai, "my-sai", RotationModePatchPods); got != "my-sai-token-abcde" {
+		t.Errorf("RotationModePatchPods: expected the SAI's current secret name, got %q", got)
+	}
+
+	if got, want := secretNameFor(sai, "my-sai", RotationModeStableSecret), StableSecretName("my-sai"); got != want {
+		t.Errorf("RotationModeStableSecret: expected the stable secret name %q, got %q", want, got)
+	}
+}
+
+func TestMutatePodsFnRawSecret(t *testing.T) {
+	sai := &v1alpha1.ServiceAccountImport{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sai", Namespace: "ns"},
+		Status: v1alpha1.ServiceAccountImportStatus{
+			Secrets: []corev1.LocalObjectReference{{Name: "my-sai-token-abcde"}},
+		},
+	}
+	h := &Handler{client: fake.NewFakeClient(sai)}
+	req := atypes.Request{AdmissionRequest: &admissionv1beta1.AdmissionRequest{Namespace: "ns"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ns",
+			Annotations: map[string]string{AnnotationKeyServiceAccountImportName: "my-sai"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "main"}}},
+	}
+
+	if err := h.mutatePodsFn(context.Background(), req, pod); err != nil {
+		t.Fatalf("mutatePodsFn: %v", err)
+	}
+
+	if len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].Secret == nil || pod.Spec.Volumes[0].Secret.SecretName != "my-sai-token-abcde" {
+		t.Fatalf("expected a single Secret volume sourced from the SAI's current secret, got %+v", pod.Spec.Volumes)
+	}
+	wantMountPath := "/var/run/secrets/admiralty.io/serviceaccountimports/my-sai"
+	mounts := pod.Spec.Containers[0].VolumeMounts
+	if len(mounts) != 1 || mounts[0].Name != "my-sai-token-abcde" || mounts[0].MountPath != wantMountPath {
+		t.Errorf("expected the container to mount the secret volume at %s, got %+v", wantMountPath, mounts)
+	}
+}
+
+func TestMutatePodsFnProjected(t *testing.T) {
+	sai := &v1alpha1.ServiceAccountImport{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sai", Namespace: "ns"},
+		Status: v1alpha1.ServiceAccountImportStatus{
+			Secrets: []corev1.LocalObjectReference{{Name: "my-sai-token-abcde"}},
+		},
+	}
+	h := &Handler{client: fake.NewFakeClient(sai)}
+	req := atypes.Request{AdmissionRequest: &admissionv1beta1.AdmissionRequest{Namespace: "ns"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Annotations: map[string]string{
+				AnnotationKeyServiceAccountImportName:      "my-sai",
+				AnnotationKeyServiceAccountImportProjected: "true",
+			},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "main"}}},
+	}
+
+	if err := h.mutatePodsFn(context.Background(), req, pod); err != nil {
+		t.Fatalf("mutatePodsFn: %v", err)
+	}
+
+	if len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].Projected == nil {
+		t.Fatalf("expected a single projected volume, got %+v", pod.Spec.Volumes)
+	}
+	sources := pod.Spec.Volumes[0].Projected.Sources
+	if len(sources) != 3 || sources[0].Secret == nil || sources[1].Secret == nil || sources[2].DownwardAPI == nil {
+		t.Fatalf("expected token and ca.crt secret projections plus a downward-API namespace file, got %+v", sources)
+	}
+	if sources[0].Secret.Name != "my-sai-token-abcde" || sources[1].Secret.Name != "my-sai-token-abcde" {
+		t.Errorf("expected both secret projections to source the SAI's current secret, got %+v", sources)
+	}
+
+	if got, want := pod.Annotations[annotationKeyFor("my-sai", "expirationSeconds")], "3600"; got != want {
+		t.Errorf("expected the default expirationSeconds to be recorded back onto the pod, got %q want %q", got, want)
+	}
+}
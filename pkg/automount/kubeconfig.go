@@ -0,0 +1,150 @@
+/*
+Copyright 2018 The Multicluster-Service-Account Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package automount
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"admiralty.io/multicluster-service-account/pkg/apis/multicluster/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// serviceAccountImportKind is used to set an OwnerReference from a generated
+// kubeconfig Secret back to the ServiceAccountImport it was rendered for, so the
+// Secret is garbage-collected along with the import instead of leaking indefinitely.
+var serviceAccountImportKind = v1alpha1.SchemeGroupVersion.WithKind("ServiceAccountImport")
+
+// kubeconfigEnvVar is the environment variable client-go and kubectl look for an
+// explicit kubeconfig path (or colon-separated list of paths) in, so that unmodified
+// workloads target the remote cluster a service account import was created from.
+const kubeconfigEnvVar = "KUBECONFIG"
+
+// kubeconfigSecretNameFor names the Secret that holds the rendered kubeconfig for a
+// service account import's token Secret.
+func kubeconfigSecretNameFor(tokenSecretName string) string {
+	return tokenSecretName + "-kubeconfig"
+}
+
+// ensureKubeconfigSecret renders a kubeconfig (server URL, CA, token file reference)
+// for a service account import into its own Secret, owned by the SAI so it is
+// garbage-collected with it, creating or updating it as needed (skipping the write
+// when the rendered kubeconfig hasn't changed, since this runs on the admission path),
+// and returns that Secret's name. The CA comes from the ca.crt key of the import's
+// existing token Secret.
+//
+// serverURL is supplied by the caller today (via the per-import "...server" pod
+// annotation), which only covers the case where the pod author knows and repeats the
+// remote API server URL by hand. This tree has neither a ClusterRegistry Cluster type
+// nor a ServiceAccountImport.Spec field to source it from automatically, so that part
+// of the request is not implemented: wiring this up to read the Cluster object (or a
+// new Spec field) the import was created from, so client-go/kubectl workloads need
+// zero extra pod configuration, is left as follow-up work once those types exist here.
+func (h *Handler) ensureKubeconfigSecret(ctx context.Context, sai *v1alpha1.ServiceAccountImport, tokenSecretName, tokenMountPath, serverURL string) (string, error) {
+	ns := sai.Namespace
+
+	tokenSecret := &corev1.Secret{}
+	if err := h.client.Get(ctx, types.NamespacedName{Namespace: ns, Name: tokenSecretName}, tokenSecret); err != nil {
+		return "", fmt.Errorf("cannot read secret %s in namespace %s: %v", tokenSecretName, ns, err)
+	}
+
+	cfg := clientcmdapi.NewConfig()
+	cfg.Clusters["default"] = &clientcmdapi.Cluster{
+		Server:                   serverURL,
+		CertificateAuthorityData: tokenSecret.Data[caCertPath],
+	}
+	cfg.AuthInfos["default"] = &clientcmdapi.AuthInfo{
+		TokenFile: fmt.Sprintf("%s/token", tokenMountPath),
+	}
+	cfg.Contexts["default"] = &clientcmdapi.Context{Cluster: "default", AuthInfo: "default"}
+	cfg.CurrentContext = "default"
+
+	data, err := clientcmd.Write(*cfg)
+	if err != nil {
+		return "", fmt.Errorf("cannot render kubeconfig for secret %s in namespace %s: %v", tokenSecretName, ns, err)
+	}
+
+	secretName := kubeconfigSecretNameFor(tokenSecretName)
+	isController := true
+	desired := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: ns,
+			// so the Secret is garbage-collected when the SAI is deleted, instead of
+			// leaking once its pods are gone too.
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: serviceAccountImportKind.GroupVersion().String(),
+				Kind:       serviceAccountImportKind.Kind,
+				Name:       sai.Name,
+				UID:        sai.UID,
+				Controller: &isController,
+			}},
+		},
+		Data: map[string][]byte{"kubeconfig": data},
+	}
+
+	existing := &corev1.Secret{}
+	err = h.client.Get(ctx, types.NamespacedName{Namespace: ns, Name: secretName}, existing)
+	if apierrors.IsNotFound(err) {
+		if err := h.client.Create(ctx, desired); err != nil && !apierrors.IsAlreadyExists(err) {
+			return "", fmt.Errorf("cannot create secret %s in namespace %s: %v", secretName, ns, err)
+		}
+		return secretName, nil
+	} else if err != nil {
+		return "", fmt.Errorf("cannot read secret %s in namespace %s: %v", secretName, ns, err)
+	}
+
+	// Avoid writing on every admission: the rendered kubeconfig only changes when the
+	// server URL or the backing token Secret's CA changes, so skip the Update otherwise
+	// to keep this side effect on the admission hot path as rare as possible.
+	if bytes.Equal(existing.Data["kubeconfig"], data) {
+		return secretName, nil
+	}
+
+	existing.Data = desired.Data
+	if err := h.client.Update(ctx, existing); err != nil {
+		return "", fmt.Errorf("cannot update secret %s in namespace %s: %v", secretName, ns, err)
+	}
+	return secretName, nil
+}
+
+// setKubeconfigEnv sets (or extends, client-go style colon-separated) the KUBECONFIG
+// env var on every container and init container of the pod, so they pick up the
+// generated kubeconfig(s) for the pod's service account imports.
+func setKubeconfigEnv(pod *corev1.Pod, joinedPaths string) {
+	setOnContainer := func(c *corev1.Container) {
+		for i, e := range c.Env {
+			if e.Name == kubeconfigEnvVar {
+				c.Env[i].Value = e.Value + ":" + joinedPaths
+				return
+			}
+		}
+		c.Env = append(c.Env, corev1.EnvVar{Name: kubeconfigEnvVar, Value: joinedPaths})
+	}
+	for i := range pod.Spec.Containers {
+		setOnContainer(&pod.Spec.Containers[i])
+	}
+	for i := range pod.Spec.InitContainers {
+		setOnContainer(&pod.Spec.InitContainers[i])
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2018 The Multicluster-Service-Account Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package automount
+
+import (
+	"context"
+	"testing"
+
+	"admiralty.io/multicluster-service-account/pkg/apis/multicluster/v1alpha1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	atypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+func TestMutatePodsFnKubeconfig(t *testing.T) {
+	sai := &v1alpha1.ServiceAccountImport{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sai", Namespace: "ns"},
+		Status: v1alpha1.ServiceAccountImportStatus{
+			Secrets: []corev1.LocalObjectReference{{Name: "my-sai-token-abcde"}},
+		},
+	}
+	tokenSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sai-token-abcde", Namespace: "ns"},
+		Data:       map[string][]byte{caCertPath: []byte("test-ca")},
+	}
+	h := &Handler{client: fake.NewFakeClient(sai, tokenSecret)}
+	req := atypes.Request{AdmissionRequest: &admissionv1beta1.AdmissionRequest{Namespace: "ns"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Annotations: map[string]string{
+				AnnotationKeyServiceAccountImportName: "my-sai",
+				annotationKeyFor("my-sai", "server"):  "https://remote.example.com",
+			},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "main"}}},
+	}
+
+	if err := h.mutatePodsFn(context.Background(), req, pod); err != nil {
+		t.Fatalf("mutatePodsFn: %v", err)
+	}
+
+	kubeconfigSecretName := kubeconfigSecretNameFor("my-sai-token-abcde")
+	kubeconfigSecret := &corev1.Secret{}
+	if err := h.client.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: kubeconfigSecretName}, kubeconfigSecret); err != nil {
+		t.Fatalf("expected kubeconfig secret %s to be created: %v", kubeconfigSecretName, err)
+	}
+	if len(kubeconfigSecret.OwnerReferences) != 1 || kubeconfigSecret.OwnerReferences[0].Name != "my-sai" {
+		t.Errorf("expected the kubeconfig secret to be owned by the SAI, got %+v", kubeconfigSecret.OwnerReferences)
+	}
+	renderedCfg, err := clientcmd.Load(kubeconfigSecret.Data["kubeconfig"])
+	if err != nil {
+		t.Fatalf("cannot parse rendered kubeconfig: %v", err)
+	}
+	cluster := renderedCfg.Clusters["default"]
+	if cluster == nil || cluster.Server != "https://remote.example.com" || string(cluster.CertificateAuthorityData) != "test-ca" {
+		t.Errorf("expected the rendered kubeconfig to reference the server URL and CA, got %+v", cluster)
+	}
+
+	if !hasVolume(pod, kubeconfigSecretName) {
+		t.Errorf("expected the pod to mount the kubeconfig secret as a volume")
+	}
+	wantEnv := "/var/run/secrets/admiralty.io/serviceaccountimports/my-sai/kubeconfig"
+	env := pod.Spec.Containers[0].Env
+	if len(env) != 1 || env[0].Name != kubeconfigEnvVar || env[0].Value != wantEnv {
+		t.Errorf("expected KUBECONFIG=%s on the container, got %+v", wantEnv, env)
+	}
+
+	// A second admission for the same, unchanged service account import must not
+	// rewrite the kubeconfig secret, since ensureKubeconfigSecret skips the Update
+	// when the rendered kubeconfig hasn't changed.
+	before := kubeconfigSecret.ResourceVersion
+	pod2 := pod.DeepCopy()
+	pod2.Spec.Containers[0].Env = nil
+	if err := h.mutatePodsFn(context.Background(), req, pod2); err != nil {
+		t.Fatalf("mutatePodsFn (second admission): %v", err)
+	}
+	after := &corev1.Secret{}
+	if err := h.client.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: kubeconfigSecretName}, after); err != nil {
+		t.Fatalf("re-reading kubeconfig secret: %v", err)
+	}
+	if after.ResourceVersion != before {
+		t.Errorf("expected the unchanged kubeconfig secret to be left alone, resourceVersion changed from %q to %q", before, after.ResourceVersion)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2018 The Multicluster-Service-Account Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rotation reacts to a ServiceAccountImport's backing Secret changing (e.g. on
+// remote token refresh or projected-token expiry) so that pods which mounted the old
+// Secret name don't keep running against a stale one. Reconciler is only enqueued when
+// Status.Secrets[0].Name actually changes between the old and new object it observes,
+// and then, per RotationMode, either updates a stable Secret's contents in place or
+// tries to repoint affected pods' volumes at the new Secret name, deleting the ones it
+// cannot repoint so their owning controller recreates them against it.
+package rotation // import "admiralty.io/multicluster-service-account/pkg/automount/rotation"
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"admiralty.io/multicluster-service-account/pkg/apis/multicluster/v1alpha1"
+	"admiralty.io/multicluster-service-account/pkg/automount"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Add registers a controller with mgr that reconciles ServiceAccountImports whose
+// backing Secret has rotated, per mode. The command wiring up the admission webhook
+// should pass the same mode to this controller as it does to automount.Handler.
+func Add(mgr manager.Manager, mode automount.RotationMode) error {
+	r := &Reconciler{client: mgr.GetClient(), mode: mode}
+	c, err := controller.New("serviceaccountimport-rotation-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	return c.Watch(&source.Kind{Type: &v1alpha1.ServiceAccountImport{}}, &handler.EnqueueRequestForObject{}, predicate.Funcs{
+		CreateFunc: func(event.CreateEvent) bool { return false },
+		DeleteFunc: func(event.DeleteEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			old, ok := e.ObjectOld.(*v1alpha1.ServiceAccountImport)
+			if !ok {
+				return false
+			}
+			updated, ok := e.ObjectNew.(*v1alpha1.ServiceAccountImport)
+			if !ok {
+				return false
+			}
+			return secretName(old) != secretName(updated)
+		},
+	})
+}
+
+// Reconciler reacts to a ServiceAccountImport's backing Secret having rotated.
+type Reconciler struct {
+	client client.Client
+	mode   automount.RotationMode
+}
+
+// Reconciler implements reconcile.Reconciler.
+var _ reconcile.Reconciler = &Reconciler{}
+
+func (r *Reconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
+	ctx := context.Background()
+
+	sai := &v1alpha1.ServiceAccountImport{}
+	if err := r.client.Get(ctx, req.NamespacedName, sai); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	current := secretName(sai)
+	if current == "" {
+		return reconcile.Result{}, nil
+	}
+
+	if r.mode == automount.RotationModeStableSecret {
+		return reconcile.Result{}, r.reconcileStableSecret(ctx, sai, current)
+	}
+	return reconcile.Result{}, r.reconcilePatchPods(ctx, sai, current)
+}
+
+// reconcileStableSecret keeps the pod-facing StableSecretName Secret's contents in
+// sync with the SAI's current backing Secret, so pods mounting it never see rotation.
+func (r *Reconciler) reconcileStableSecret(ctx context.Context, sai *v1alpha1.ServiceAccountImport, currentSecretName string) error {
+	src := &corev1.Secret{}
+	if err := r.client.Get(ctx, types.NamespacedName{Namespace: sai.Namespace, Name: currentSecretName}, src); err != nil {
+		return fmt.Errorf("cannot read secret %s in namespace %s: %v", currentSecretName, sai.Namespace, err)
+	}
+
+	stableName := automount.StableSecretName(sai.Name)
+	dst := &corev1.Secret{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: sai.Namespace, Name: stableName}, dst)
+	if apierrors.IsNotFound(err) {
+		dst = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: stableName, Namespace: sai.Namespace},
+			Data:       src.Data,
+		}
+		return r.client.Create(ctx, dst)
+	} else if err != nil {
+		return fmt.Errorf("cannot read secret %s in namespace %s: %v", stableName, sai.Namespace, err)
+	}
+
+	dst.Data = src.Data
+	return r.client.Update(ctx, dst)
+}
+
+// staleSecretAnnotation is left on a pod right before it is evicted for mounting a
+// rotated-away Secret, so that its owning controller's recreated replacement (and
+// anyone inspecting the terminating pod in the meantime) can tell why it was deleted.
+const staleSecretAnnotation = "multicluster.admiralty.io/service-account-import.rotated-secret"
+
+// reconcilePatchPods retargets the volume of pods that mounted this SAI at its stable
+// mount path onto the SAI's current backing Secret, where the API server allows the
+// pod update (pod.spec.volumes is immutable on most Kubernetes versions, so this is
+// expected to fail more often than not). Pods it cannot patch in place are instead
+// annotated and deleted, so their owning controller (Deployment, Job, ...) recreates
+// them against the current Secret. This covers both the plain Secret volume mounted by
+// default and the projected volume mounted in Handler's projected-token mode (chunk0-1),
+// whose Secret projections reference the rotating Secret by name just as directly.
+func (r *Reconciler) reconcilePatchPods(ctx context.Context, sai *v1alpha1.ServiceAccountImport, currentSecretName string) error {
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, &client.ListOptions{Namespace: sai.Namespace}, pods); err != nil {
+		return fmt.Errorf("cannot list pods in namespace %s: %v", sai.Namespace, err)
+	}
+
+	mountPath := fmt.Sprintf("/var/run/secrets/admiralty.io/serviceaccountimports/%s", sai.Name)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		volumeName := volumeNameMountedAt(pod, mountPath)
+		if volumeName == "" {
+			continue
+		}
+
+		for j := range pod.Spec.Volumes {
+			v := &pod.Spec.Volumes[j]
+			if v.Name != volumeName || !volumeReferencesStaleSecret(v, currentSecretName) {
+				continue
+			}
+
+			unpatched := pod.DeepCopy()
+			retargetVolume(v, currentSecretName)
+			if err := r.client.Update(ctx, pod); err == nil {
+				break
+			}
+
+			log.Printf("cannot patch volume %s of pod %s/%s to secret %s, evicting it so its owning controller recreates it: %v",
+				volumeName, pod.Namespace, pod.Name, currentSecretName, err)
+			// annotate the pod as stored, not with the rejected volume change
+			if err := r.evictStalePod(ctx, unpatched, currentSecretName); err != nil {
+				log.Printf("cannot evict stale pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// volumeReferencesStaleSecret reports whether v sources any of its content from a
+// Secret other than currentSecretName, whether mounted directly (the default mode) or
+// via one or more SecretProjections inside a projected volume (Handler's projected-token
+// mode).
+func volumeReferencesStaleSecret(v *corev1.Volume, currentSecretName string) bool {
+	if v.Secret != nil {
+		return v.Secret.SecretName != "" && v.Secret.SecretName != currentSecretName
+	}
+	if v.Projected != nil {
+		for _, src := range v.Projected.Sources {
+			if src.Secret != nil && src.Secret.Name != "" && src.Secret.Name != currentSecretName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retargetVolume rewrites every Secret reference in v (direct or projected) to
+// currentSecretName.
+func retargetVolume(v *corev1.Volume, currentSecretName string) {
+	if v.Secret != nil {
+		v.Secret.SecretName = currentSecretName
+		return
+	}
+	if v.Projected != nil {
+		for i := range v.Projected.Sources {
+			if v.Projected.Sources[i].Secret != nil {
+				v.Projected.Sources[i].Secret.Name = currentSecretName
+			}
+		}
+	}
+}
+
+// evictStalePod annotates a pod with the Secret name it should have been mounting,
+// then deletes it, so that an owning controller recreates it through admission again.
+// A pod with no owning controller is left deleted rather than recreated, same as the
+// outcome of deleting any other such pod.
+func (r *Reconciler) evictStalePod(ctx context.Context, pod *corev1.Pod, currentSecretName string) error {
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[staleSecretAnnotation] = currentSecretName
+	if err := r.client.Update(ctx, pod); err != nil {
+		return fmt.Errorf("cannot annotate pod before eviction: %v", err)
+	}
+	return r.client.Delete(ctx, pod)
+}
+
+// volumeNameMountedAt returns the name of the volume mounted at mountPath by any of
+// the pod's containers, or "" if none is.
+func volumeNameMountedAt(pod *corev1.Pod, mountPath string) string {
+	for _, c := range pod.Spec.Containers {
+		for _, m := range c.VolumeMounts {
+			if m.MountPath == mountPath {
+				return m.Name
+			}
+		}
+	}
+	return ""
+}
+
+func secretName(sai *v1alpha1.ServiceAccountImport) string {
+	if len(sai.Status.Secrets) == 0 {
+		return ""
+	}
+	return sai.Status.Secrets[0].Name
+}
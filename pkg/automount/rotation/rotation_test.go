@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Multicluster-Service-Account Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rotation
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"admiralty.io/multicluster-service-account/pkg/apis/multicluster/v1alpha1"
+	"admiralty.io/multicluster-service-account/pkg/automount"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// podVolumeUpdateRejectingClient simulates the real API server rejecting an in-place
+// update to pod.spec.volumes (an immutable field), which the fake client otherwise
+// allows. It rejects exactly the retarget attempt in reconcilePatchPods -- identified
+// by the pod not yet carrying staleSecretAnnotation -- and passes every other Update
+// (including the annotate-before-evict one) through to the embedded fake client, saving
+// a copy of the annotated pod as it goes so the test can inspect it after deletion.
+type podVolumeUpdateRejectingClient struct {
+	client.Client
+	annotatedBeforeEviction *corev1.Pod
+}
+
+func (c *podVolumeUpdateRejectingClient) Update(ctx context.Context, obj runtime.Object) error {
+	if pod, ok := obj.(*corev1.Pod); ok {
+		if _, annotated := pod.Annotations[staleSecretAnnotation]; !annotated {
+			return fmt.Errorf("simulated: pod.spec.volumes is immutable")
+		}
+		c.annotatedBeforeEviction = pod.DeepCopy()
+	}
+	return c.Client.Update(ctx, obj)
+}
+
+func TestReconcileStableSecretCreatesAndUpdates(t *testing.T) {
+	sai := &v1alpha1.ServiceAccountImport{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sai", Namespace: "ns"},
+		Status: v1alpha1.ServiceAccountImportStatus{
+			Secrets: []corev1.LocalObjectReference{{Name: "my-sai-token-v2"}},
+		},
+	}
+	currentSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sai-token-v2", Namespace: "ns"},
+		Data:       map[string][]byte{"token": []byte("v2-token")},
+	}
+
+	c := fake.NewFakeClient(sai, currentSecret)
+	r := &Reconciler{client: c, mode: automount.RotationModeStableSecret}
+
+	if err := r.reconcileStableSecret(context.Background(), sai, "my-sai-token-v2"); err != nil {
+		t.Fatalf("reconcileStableSecret (create): %v", err)
+	}
+
+	stable := &corev1.Secret{}
+	stableName := automount.StableSecretName("my-sai")
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: stableName}, stable); err != nil {
+		t.Fatalf("expected stable secret %s to be created: %v", stableName, err)
+	}
+	if string(stable.Data["token"]) != "v2-token" {
+		t.Errorf("expected stable secret to mirror current secret's data, got %q", stable.Data["token"])
+	}
+
+	// A later rotation updates the same stable secret's contents in place.
+	currentSecret.Data["token"] = []byte("v3-token")
+	if err := c.Update(context.Background(), currentSecret); err != nil {
+		t.Fatalf("updating source secret: %v", err)
+	}
+	if err := r.reconcileStableSecret(context.Background(), sai, "my-sai-token-v2"); err != nil {
+		t.Fatalf("reconcileStableSecret (update): %v", err)
+	}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: stableName}, stable); err != nil {
+		t.Fatalf("re-reading stable secret: %v", err)
+	}
+	if string(stable.Data["token"]) != "v3-token" {
+		t.Errorf("expected stable secret to pick up the rotated contents, got %q", stable.Data["token"])
+	}
+}
+
+func TestReconcilePatchPodsEvictsWhenPatchIsRejected(t *testing.T) {
+	sai := &v1alpha1.ServiceAccountImport{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sai", Namespace: "ns"},
+		Status: v1alpha1.ServiceAccountImportStatus{
+			Secrets: []corev1.LocalObjectReference{{Name: "my-sai-token-v2"}},
+		},
+	}
+	mountPath := "/var/run/secrets/admiralty.io/serviceaccountimports/my-sai"
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "consumer", Namespace: "ns"},
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{
+				Name:         "my-sai-token-v1",
+				VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "my-sai-token-v1"}},
+			}},
+			Containers: []corev1.Container{{
+				Name:         "main",
+				VolumeMounts: []corev1.VolumeMount{{Name: "my-sai-token-v1", MountPath: mountPath}},
+			}},
+		},
+	}
+
+	c := &podVolumeUpdateRejectingClient{Client: fake.NewFakeClient(sai, pod)}
+	r := &Reconciler{client: c, mode: automount.RotationModePatchPods}
+
+	if err := r.reconcilePatchPods(context.Background(), sai, "my-sai-token-v2"); err != nil {
+		t.Fatalf("reconcilePatchPods: %v", err)
+	}
+
+	got := &corev1.Pod{}
+	err := c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: "consumer"}, got)
+	if err == nil {
+		t.Fatalf("expected pod to have been evicted after its volume update was rejected, but it still exists: %+v", got)
+	}
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("expected a not-found error reading the evicted pod, got: %v", err)
+	}
+
+	if c.annotatedBeforeEviction == nil {
+		t.Fatal("expected the pod to have been annotated with staleSecretAnnotation before eviction")
+	}
+	if got := c.annotatedBeforeEviction.Annotations[staleSecretAnnotation]; got != "my-sai-token-v2" {
+		t.Errorf("expected staleSecretAnnotation to record the current secret name %q, got %q", "my-sai-token-v2", got)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 The Multicluster-Service-Account Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package automount
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"admiralty.io/multicluster-service-account/pkg/apis/multicluster/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/runtime/inject"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	atypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+// ValidatingHandler validates pods annotated with the
+// "multicluster.admiralty.io/service-account-import.name" key, rejecting ones whose
+// annotation is unusable: naming service account imports that do not exist, that have
+// no token yet, or whose mount path collides with a volume mount the user already
+// declared. It is the validating counterpart to Handler: Handler tolerates the race
+// between pod and SAI creation by erroring (so the webhook configuration should let it
+// fail open), while ValidatingHandler is meant to be registered fail-closed, so that a
+// bad manifest is rejected with a clear message instead of silently left unmounted or
+// half-mutated. Since it runs against the already-mutated pod, RotationMode must be
+// set to the same value as the Handler it follows, so it computes the same mounted
+// Secret name and doesn't mistake Handler's own mount for a user collision.
+type ValidatingHandler struct {
+	decoder atypes.Decoder
+	client  client.Client
+
+	// RotationMode must match the Handler registered for the same pods; see Handler.RotationMode.
+	RotationMode RotationMode
+}
+
+func (h *ValidatingHandler) Handle(ctx context.Context, req atypes.Request) atypes.Response {
+	pod := &corev1.Pod{}
+	if err := h.decoder.Decode(req, pod); err != nil {
+		err := fmt.Errorf("cannot decode admission request for object %s in namespace %s: %v",
+			req.AdmissionRequest.Name, req.AdmissionRequest.Namespace, err)
+		return admission.ErrorResponse(http.StatusBadRequest, err)
+	}
+
+	if err := h.validatePod(ctx, req, pod); err != nil {
+		return admission.ValidationResponse(false, err.Error())
+	}
+
+	return admission.ValidationResponse(true, "")
+}
+
+func (h *ValidatingHandler) validatePod(ctx context.Context, req atypes.Request, pod *corev1.Pod) error {
+	saiNamesStr, ok := pod.Annotations[AnnotationKeyServiceAccountImportName]
+	if !ok {
+		return nil
+	}
+
+	ns := getNamespace(pod, req.AdmissionRequest)
+
+	saiNames := strings.Split(saiNamesStr, ",")
+	for _, saiName := range saiNames {
+		sai := &v1alpha1.ServiceAccountImport{}
+		if err := h.client.Get(ctx, types.NamespacedName{Namespace: ns, Name: saiName}, sai); err != nil {
+			return fmt.Errorf("service account import %s does not exist in namespace %s", saiName, ns)
+		}
+
+		if len(sai.Status.Secrets) == 0 {
+			return fmt.Errorf("service account import %s in namespace %s has no token yet", saiName, ns)
+		}
+
+		secretName := secretNameFor(sai, saiName, h.RotationMode)
+		mountPath := fmt.Sprintf("/var/run/secrets/admiralty.io/serviceaccountimports/%s", saiName)
+		if err := checkNoMountPathCollision(pod.Spec.Containers, secretName, mountPath); err != nil {
+			return err
+		}
+		if err := checkNoMountPathCollision(pod.Spec.InitContainers, secretName, mountPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkNoMountPathCollision returns an error if a container already declares a volume
+// mount at mountPath under a volume other than the one this admission would add
+// (ourVolumeName), meaning the pod author already used that path for something else.
+func checkNoMountPathCollision(containers []corev1.Container, ourVolumeName, mountPath string) error {
+	for _, c := range containers {
+		for _, m := range c.VolumeMounts {
+			if m.MountPath == mountPath && m.Name != ourVolumeName {
+				return fmt.Errorf("container %s already has a volume mount at %s", c.Name, mountPath)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidatingHandler implements inject.Client.
+// A client will be automatically injected.
+var _ inject.Client = &ValidatingHandler{}
+
+// InjectClient injects the client.
+func (h *ValidatingHandler) InjectClient(c client.Client) error {
+	h.client = c
+	return nil
+}
+
+// ValidatingHandler implements inject.Decoder.
+// A decoder will be automatically injected.
+var _ inject.Decoder = &ValidatingHandler{}
+
+// InjectDecoder injects the decoder.
+func (h *ValidatingHandler) InjectDecoder(d atypes.Decoder) error {
+	h.decoder = d
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2018 The Multicluster-Service-Account Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package automount
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCheckNoMountPathCollision(t *testing.T) {
+	const mountPath = "/var/run/secrets/admiralty.io/serviceaccountimports/my-sai"
+
+	cases := []struct {
+		name       string
+		containers []corev1.Container
+		wantErr    bool
+	}{
+		{
+			name:       "no containers",
+			containers: nil,
+			wantErr:    false,
+		},
+		{
+			name: "our own mount at that path is not a collision",
+			containers: []corev1.Container{
+				{Name: "c", VolumeMounts: []corev1.VolumeMount{{Name: "my-sai-token", MountPath: mountPath}}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "a different volume already mounted at that path is a collision",
+			containers: []corev1.Container{
+				{Name: "c", VolumeMounts: []corev1.VolumeMount{{Name: "user-volume", MountPath: mountPath}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "a mount at a different path is never a collision",
+			containers: []corev1.Container{
+				{Name: "c", VolumeMounts: []corev1.VolumeMount{{Name: "user-volume", MountPath: "/etc/config"}}},
+			},
+			wantErr: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkNoMountPathCollision(c.containers, "my-sai-token", mountPath)
+			if (err != nil) != c.wantErr {
+				t.Errorf("checkNoMountPathCollision() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}